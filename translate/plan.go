@@ -0,0 +1,352 @@
+// Copyright 2019 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/coreos/ignition/v2/config/util"
+	"github.com/coreos/vcontext/path"
+)
+
+/*
+ * translate() used to walk the (fromType, toType) tree twice on every call:
+ * once to decide whether a pair was translatable, and again to actually copy
+ * the data. Both walks did the same reflect.Type.FieldByName lookups. Instead,
+ * the first time a (fromType, toType) pair is seen for a given tag pair, we
+ * compile it down into a plan: an immutable tree of ops that already knows
+ * which fields line up and which custom translators apply. The plan is
+ * memoized in the Translator's planCache and reused for the life of that Translator.
+ */
+
+// translateTagKey is the struct tag used to pick a custom translator by name,
+// for fields whose type alone is not enough to disambiguate (see AddNamedTranslator).
+const translateTagKey = "translate"
+
+type opKind int
+
+const (
+	// set vTo to convert(vFrom) and record a translation from fromPath to toPath
+	opSetPrimitive opKind = iota
+	// dereference vFrom, allocate vTo, and recurse using sub
+	opRecursePtr
+	// allocate a slice of vFrom's length and recurse into each element using sub
+	opRangeSlice
+	// allocate a map and recurse into each value using sub, deriving a path segment from each key
+	opRangeMap
+	// copy one struct field, recursing into it using sub
+	opIterateStructField
+	// call a registered custom translator function and rebase the translations it returns
+	opCallCustomTranslator
+)
+
+// op is one instruction in a plan. Only the fields relevant to its kind are set.
+type op struct {
+	kind opKind
+
+	// opSetPrimitive
+	convert func(reflect.Value) reflect.Value
+
+	// opRecursePtr, opRangeSlice, opRangeMap (value), opIterateStructField
+	sub *plan
+
+	// opRangeMap
+	keyConvert func(reflect.Value) reflect.Value
+
+	// opIterateStructField
+	fromIndex int
+	toIndex   []int
+	fromName  string
+	toName    string
+	anonymous bool
+
+	// opCallCustomTranslator
+	fn reflect.Value
+}
+
+// plan is the compiled set of ops for translating one (fromType, toType) pair.
+// A struct plan holds one opIterateStructField per field; every other kind of
+// plan holds exactly one op.
+type plan struct {
+	ops []op
+}
+
+type planKey struct {
+	from, to       reflect.Type
+	fromTag, toTag string
+}
+
+// newPlanCache returns a fresh, empty plan cache for one Translator instance.
+// A plan bakes in decisions that are specific to the Translator that built it
+// (which custom/named translators are registered, whether struct renames are
+// allowed), so the cache must not be shared across Translator instances: two
+// Translators translating the same (fromType, toType) pair can legitimately
+// disagree on how to do it.
+func newPlanCache() *sync.Map {
+	return &sync.Map{}
+}
+
+// getPlan returns the plan for (from, to) from t's cache, building it if this
+// is the first time the pair has been seen by t. The cache entry is inserted
+// before the plan body is filled in so that self-referential types (a struct
+// containing a pointer to itself) tie back to the same *plan instead of
+// recursing forever; if buildPlan panics, the placeholder is removed so a
+// later call doesn't find a permanently empty plan.
+func getPlan(t translator, from, to reflect.Type, fromTag, toTag string) *plan {
+	key := planKey{from, to, fromTag, toTag}
+	if v, ok := t.planCache.Load(key); ok {
+		return v.(*plan)
+	}
+	p := &plan{}
+	actual, loaded := t.planCache.LoadOrStore(key, p)
+	if loaded {
+		return actual.(*plan)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			t.planCache.Delete(key)
+		}
+	}()
+	buildPlan(t, p, from, to, fromTag, toTag)
+	ok = true
+	return p
+}
+
+func buildPlan(t translator, p *plan, from, to reflect.Type, fromTag, toTag string) {
+	if fnv := t.getTranslator(from, to); fnv.IsValid() {
+		p.ops = []op{{kind: opCallCustomTranslator, fn: fnv}}
+		return
+	}
+
+	k := from.Kind()
+	if to.Kind() != k {
+		panic(fmt.Sprintf("Translator not defined for %v to %v", from, to))
+	}
+	switch {
+	case util.IsPrimitive(k):
+		toType := to
+		p.ops = []op{{kind: opSetPrimitive, convert: func(v reflect.Value) reflect.Value {
+			return v.Convert(toType)
+		}}}
+	case k == reflect.Map:
+		// util.IsInvalidInConfig predates map support and treats reflect.Map as invalid,
+		// so this case must be checked before it.
+		sub := getPlan(t, from.Elem(), to.Elem(), fromTag, toTag)
+		p.ops = []op{{kind: opRangeMap, sub: sub, keyConvert: buildKeyConvert(t, from.Key(), to.Key())}}
+	case util.IsInvalidInConfig(k):
+		panic(fmt.Sprintf("Encountered invalid kind %s in config. This is a bug, please file a report", k))
+	case k == reflect.Ptr:
+		sub := getPlan(t, from.Elem(), to.Elem(), fromTag, toTag)
+		p.ops = []op{{kind: opRecursePtr, sub: sub}}
+	case k == reflect.Slice:
+		sub := getPlan(t, from.Elem(), to.Elem(), fromTag, toTag)
+		p.ops = []op{{kind: opRangeSlice, sub: sub}}
+	case k == reflect.Struct:
+		buildStructPlan(t, p, from, to, fromTag, toTag)
+	default:
+		panic(fmt.Sprintf("Encountered unknown kind %s in config. This is a bug, please file a report", k))
+	}
+}
+
+// precondition: from, to are both of Kind 'struct'
+func buildStructPlan(t translator, p *plan, from, to reflect.Type, fromTag, toTag string) {
+	if from.NumField() != to.NumField() {
+		panic(fmt.Sprintf("Translator not defined for %v to %v", from, to))
+	}
+	// Type aliases (e.g. `type Ignition = types.Ignition`) resolve to the same reflect.Type and
+	// always have matching names. A struct renamed on one side is rejected when its name pair must
+	// match (see requireNameMatch) or when it is not structurally equivalent to its counterpart.
+	if from.Name() != to.Name() {
+		if t.requireNameMatch(from.Name(), to.Name()) {
+			panic(fmt.Sprintf("Translator not defined for %v to %v: struct names do not match", from, to))
+		}
+		if !structurallyEquivalent(from, to, fromTag, toTag) {
+			panic(fmt.Sprintf("Translator not defined for %v to %v: struct names differ and they are not structurally equivalent", from, to))
+		}
+	}
+	ops := make([]op, 0, from.NumField())
+	for i := 0; i < from.NumField(); i++ {
+		fromField := from.Field(i)
+		toField, ok := to.FieldByName(fromField.Name)
+		if !ok {
+			panic("vTo did not have a matching type. This is a bug; please file a report")
+		}
+
+		var sub *plan
+		if name := fromField.Tag.Get(translateTagKey); name != "" {
+			fnv, ok := t.getNamedTranslator(name)
+			if !ok {
+				panic(fmt.Sprintf("Field %s.%s referenced undefined named translator %q", from, fromField.Name, name))
+			}
+			sub = &plan{ops: []op{{kind: opCallCustomTranslator, fn: fnv}}}
+		} else {
+			sub = getPlan(t, fromField.Type, toField.Type, fromTag, toTag)
+		}
+
+		fieldOp := op{
+			kind:      opIterateStructField,
+			sub:       sub,
+			fromIndex: i,
+			toIndex:   toField.Index,
+			anonymous: fromField.Anonymous,
+		}
+		if !fromField.Anonymous {
+			fieldOp.fromName = tagFieldName(fromField, fromTag)
+			fieldOp.toName = tagFieldName(toField, toTag)
+		}
+		ops = append(ops, fieldOp)
+	}
+	p.ops = ops
+}
+
+// structurallyEquivalent reports whether from and to, which have different type
+// names, are otherwise identical: same kind all the way down, and for structs
+// the same number of fields, each with a matching Go name, the same
+// (un)marshalled name under fromTag/toTag respectively, and a recursively
+// structurally-equivalent (or identical) type. This is the bar a
+// renamed wrapper struct must clear to be accepted in place of an exact type
+// name match; an aliased type (from == to) always clears it trivially.
+func structurallyEquivalent(from, to reflect.Type, fromTag, toTag string) bool {
+	if from == to {
+		return true
+	}
+	if from.Kind() != to.Kind() {
+		return false
+	}
+	switch from.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return structurallyEquivalent(from.Elem(), to.Elem(), fromTag, toTag)
+	case reflect.Map:
+		return structurallyEquivalent(from.Key(), to.Key(), fromTag, toTag) &&
+			structurallyEquivalent(from.Elem(), to.Elem(), fromTag, toTag)
+	case reflect.Struct:
+		if from.NumField() != to.NumField() {
+			return false
+		}
+		for i := 0; i < from.NumField(); i++ {
+			fromField := from.Field(i)
+			toField, ok := to.FieldByName(fromField.Name)
+			if !ok {
+				return false
+			}
+			if tagFieldName(fromField, fromTag) != tagFieldName(toField, toTag) {
+				return false
+			}
+			if !structurallyEquivalent(fromField.Type, toField.Type, fromTag, toTag) {
+				return false
+			}
+		}
+		return true
+	default:
+		return util.IsPrimitive(from.Kind())
+	}
+}
+
+// tagFieldName returns the name used when (un)marshalling f via tag (e.g. "json" or "yaml")
+func tagFieldName(f reflect.StructField, tag string) string {
+	if tag == "" {
+		return f.Name
+	}
+	return strings.Split(f.Tag.Get(tag), ",")[0]
+}
+
+// buildKeyConvert returns how to translate a map key: via a registered custom
+// translator if one exists for the key types, otherwise a bare Convert, which
+// requires the key kind be a primitive.
+func buildKeyConvert(t translator, fromKey, toKey reflect.Type) func(reflect.Value) reflect.Value {
+	if fnv := t.getTranslator(fromKey, toKey); fnv.IsValid() {
+		return func(v reflect.Value) reflect.Value {
+			return fnv.Call([]reflect.Value{v})[0]
+		}
+	}
+	if !util.IsPrimitive(fromKey.Kind()) {
+		panic(fmt.Sprintf("Translator not defined for %v to %v", fromKey, toKey))
+	}
+	return func(v reflect.Value) reflect.Value {
+		return v.Convert(toKey)
+	}
+}
+
+// execPlan walks p, copying data from vFrom into vTo and recording translations.
+// precondition: vFrom and vTo are the types p was built for
+// precondition: vTo is addressable and settable
+func (t translator) execPlan(p *plan, vFrom, vTo reflect.Value, fromPath, toPath path.ContextPath) {
+	if len(p.ops) == 0 {
+		return
+	}
+	if p.ops[0].kind == opIterateStructField {
+		for _, fieldOp := range p.ops {
+			vFromField := vFrom.Field(fieldOp.fromIndex)
+			vToField := vTo.FieldByIndex(fieldOp.toIndex)
+
+			from, to := fromPath, toPath
+			if !fieldOp.anonymous {
+				from = fromPath.Append(fieldOp.fromName)
+				to = toPath.Append(fieldOp.toName)
+			}
+			t.execPlan(fieldOp.sub, vFromField, vToField, from, to)
+		}
+		return
+	}
+
+	o := p.ops[0]
+	switch o.kind {
+	case opCallCustomTranslator:
+		returns := o.fn.Call([]reflect.Value{vFrom})
+		vTo.Set(returns[0])
+
+		// handle all the translations and "rebase" them to our current place
+		retSet := returns[1].Interface().(TranslationSet)
+		for _, trans := range retSet.Set {
+			from := fromPath.Append(trans.From.Path...)
+			to := toPath.Append(trans.To.Path...)
+			t.translations.AddTranslation(from, to)
+		}
+	case opSetPrimitive:
+		vTo.Set(o.convert(vFrom))
+		t.translations.AddTranslation(fromPath, toPath)
+	case opRecursePtr:
+		if vFrom.IsNil() {
+			return
+		}
+		vTo.Set(reflect.New(vTo.Type().Elem()))
+		t.execPlan(o.sub, vFrom.Elem(), vTo.Elem(), fromPath, toPath)
+	case opRangeSlice:
+		if vFrom.IsNil() {
+			return
+		}
+		vTo.Set(reflect.MakeSlice(vTo.Type(), vFrom.Len(), vFrom.Len()))
+		for i := 0; i < vFrom.Len(); i++ {
+			t.execPlan(o.sub, vFrom.Index(i), vTo.Index(i), fromPath.Append(i), toPath.Append(i))
+		}
+	case opRangeMap:
+		if vFrom.IsNil() {
+			return
+		}
+		vTo.Set(reflect.MakeMapWithSize(vTo.Type(), vFrom.Len()))
+		iter := vFrom.MapRange()
+		for iter.Next() {
+			keyTo := o.keyConvert(iter.Key())
+			valTo := reflect.New(vTo.Type().Elem()).Elem()
+			segment := fmt.Sprint(iter.Key().Interface())
+			t.execPlan(o.sub, iter.Value(), valTo, fromPath.Append(segment), toPath.Append(segment))
+			vTo.SetMapIndex(keyTo, valTo)
+		}
+	}
+}
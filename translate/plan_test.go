@@ -0,0 +1,161 @@
+// Copyright 2019 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"testing"
+)
+
+// The types below stand in for a large Butane/Ignition config: enough storage
+// files, systemd units, and LUKS devices that translating one exercises the
+// plan builder across slices, pointers, and nested structs, the same shape as
+// the fixtures this is meant to approximate.
+
+type benchFileV struct {
+	Path     string  `yaml:"path"`
+	Contents *string `yaml:"contents"`
+	Mode     *int    `yaml:"mode"`
+}
+
+type benchFile struct {
+	Path     string  `json:"path"`
+	Contents *string `json:"contents"`
+	Mode     *int    `json:"mode"`
+}
+
+type benchUnitV struct {
+	Name     string   `yaml:"name"`
+	Enabled  *bool    `yaml:"enabled"`
+	Contents *string  `yaml:"contents"`
+	Dropins  []string `yaml:"dropins"`
+}
+
+type benchUnit struct {
+	Name     string   `json:"name"`
+	Enabled  *bool    `json:"enabled"`
+	Contents *string  `json:"contents"`
+	Dropins  []string `json:"dropins"`
+}
+
+type benchLuksV struct {
+	Name    string            `yaml:"name"`
+	Device  string            `yaml:"device"`
+	Options map[string]string `yaml:"options"`
+}
+
+type benchLuks struct {
+	Name    string            `json:"name"`
+	Device  string            `json:"device"`
+	Options map[string]string `json:"options"`
+}
+
+type benchConfigV struct {
+	Files   []benchFileV `yaml:"files"`
+	Units   []benchUnitV `yaml:"units"`
+	Luks    []benchLuksV `yaml:"luks"`
+	Version string       `yaml:"version"`
+}
+
+type benchConfig struct {
+	Files   []benchFile `json:"files"`
+	Units   []benchUnit `json:"units"`
+	Luks    []benchLuks `json:"luks"`
+	Version string      `json:"version"`
+}
+
+func makeBenchConfig() benchConfigV {
+	contents := "some file contents"
+	mode := 0644
+	enabled := true
+	cfg := benchConfigV{Version: "1.5.0"}
+	for i := 0; i < 50; i++ {
+		cfg.Files = append(cfg.Files, benchFileV{Path: "/etc/file", Contents: &contents, Mode: &mode})
+	}
+	for i := 0; i < 20; i++ {
+		cfg.Units = append(cfg.Units, benchUnitV{Name: "unit.service", Enabled: &enabled, Contents: &contents, Dropins: []string{"a", "b"}})
+	}
+	for i := 0; i < 10; i++ {
+		cfg.Luks = append(cfg.Luks, benchLuksV{Name: "luks", Device: "/dev/sda", Options: map[string]string{"foo": "bar"}})
+	}
+	return cfg
+}
+
+func BenchmarkTranslateLargeConfig(b *testing.B) {
+	tr := NewTranslator("yaml", "json")
+	from := makeBenchConfig()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var to benchConfig
+		tr.Translate(&from, &to)
+	}
+}
+
+// TestGetPlanDoesNotPoisonCacheOnPanic ensures that a Translate call that panics
+// while building a plan (here, for a field of an invalid kind) does not leave a
+// permanently empty plan cached for later, successful-looking calls.
+func TestGetPlanDoesNotPoisonCacheOnPanic(t *testing.T) {
+	type fromT struct {
+		Foo chan int `yaml:"foo"`
+	}
+	type toT struct {
+		Foo chan int `json:"foo"`
+	}
+
+	tr := NewTranslator("yaml", "json")
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("call %d: expected a panic translating an invalid kind", i)
+				}
+			}()
+			var from fromT
+			var to toT
+			tr.Translate(&from, &to)
+		}()
+	}
+}
+
+// TestPlanCacheScopedPerTranslator ensures two Translators that register different
+// custom translators for the same Go type pair don't share a cached plan.
+func TestPlanCacheScopedPerTranslator(t *testing.T) {
+	type fromT struct {
+		Foo string `yaml:"foo"`
+	}
+	type toT struct {
+		Foo string `json:"foo"`
+	}
+
+	tr1 := NewTranslator("yaml", "json")
+	tr1.AddCustomTranslator(func(s string) (string, TranslationSet) {
+		return "tr1:" + s, NewTranslationSet("yaml", "json")
+	})
+	tr2 := NewTranslator("yaml", "json")
+	tr2.AddCustomTranslator(func(s string) (string, TranslationSet) {
+		return "tr2:" + s, NewTranslationSet("yaml", "json")
+	})
+
+	from := fromT{Foo: "bar"}
+	var to1, to2 toT
+	tr1.Translate(&from, &to1)
+	tr2.Translate(&from, &to2)
+
+	if to1.Foo != "tr1:bar" {
+		t.Errorf("tr1: expected tr1:bar, got %s", to1.Foo)
+	}
+	if to2.Foo != "tr2:bar" {
+		t.Errorf("tr2: expected tr2:bar, got %s", to2.Foo)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"testing"
+)
+
+// outerAliasV stands in for a type that is reused directly on both sides of a
+// translation via a Go type alias (e.g. `type Ignition = types.Ignition`):
+// outerAliasTo is a true alias of outerAliasV, so they resolve to the exact
+// same reflect.Type and must be translatable even with AllowStructRename(false).
+type outerAliasV struct {
+	Name string `yaml:"name" json:"name"`
+	In   innerV `yaml:"in" json:"in"`
+}
+
+type innerV struct {
+	Foo string `yaml:"foo" json:"foo"`
+}
+
+type outerAliasTo = outerAliasV
+
+func TestStructAliasAlwaysAllowed(t *testing.T) {
+	tr := NewTranslator("yaml", "json")
+	tr.AllowStructRename(false)
+
+	from := outerAliasV{Name: "hi", In: innerV{Foo: "a"}}
+	var to outerAliasTo
+	tr.Translate(&from, &to)
+
+	if to.Name != "hi" || to.In.Foo != "a" {
+		t.Fatalf("unexpected translation result: %+v", to)
+	}
+}
+
+// innerRenamedV and innerRenamed are structurally identical (same field names,
+// same tags, same leaf types) but deliberately have different type names, as if
+// one side had renamed a wrapper struct.
+type innerRenamedV struct {
+	Foo string `yaml:"foo"`
+	Bar int    `yaml:"bar"`
+}
+
+type innerRenamed struct {
+	Foo string `json:"foo"`
+	Bar int    `json:"bar"`
+}
+
+type outerRenameFromV struct {
+	Name string        `yaml:"name"`
+	In   innerRenamedV `yaml:"in"`
+}
+
+type outerRenameTo struct {
+	Name string       `json:"name"`
+	In   innerRenamed `json:"in"`
+}
+
+func TestStructRenameAllowedByDefault(t *testing.T) {
+	tr := NewTranslator("yaml", "json")
+
+	from := outerRenameFromV{Name: "hi", In: innerRenamedV{Foo: "a", Bar: 3}}
+	var to outerRenameTo
+	tr.Translate(&from, &to)
+
+	if to.Name != "hi" || to.In.Foo != "a" || to.In.Bar != 3 {
+		t.Fatalf("unexpected translation result: %+v", to)
+	}
+}
+
+func TestStructRenameRejectedWhenDisallowed(t *testing.T) {
+	tr := NewTranslator("yaml", "json")
+	tr.AllowStructRename(false)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic translating renamed structs with AllowStructRename(false)")
+		}
+	}()
+	from := outerRenameFromV{Name: "hi", In: innerRenamedV{Foo: "a", Bar: 3}}
+	var to outerRenameTo
+	tr.Translate(&from, &to)
+}
+
+func TestStructRenameRejectedByRequireStructNameMatch(t *testing.T) {
+	tr := NewTranslator("yaml", "json")
+	tr.RequireStructNameMatch([2]string{"innerRenamedV", "innerRenamed"})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic translating a pinned (fromName, toName) pair")
+		}
+	}()
+	from := outerRenameFromV{Name: "hi", In: innerRenamedV{Foo: "a", Bar: 3}}
+	var to outerRenameTo
+	tr.Translate(&from, &to)
+}
+
+// innerDivergentV and innerDivergent have matching Go field names but a
+// different marshalled name for one field, so despite the renamed wrapper they
+// are not structurally equivalent and must be rejected even with the default,
+// lax AllowStructRename(true).
+type innerDivergentV struct {
+	Foo string `yaml:"foo"`
+}
+
+type innerDivergent struct {
+	Foo string `json:"not_foo"`
+}
+
+type outerDivergentFromV struct {
+	In innerDivergentV `yaml:"in"`
+}
+
+type outerDivergentTo struct {
+	In innerDivergent `json:"in"`
+}
+
+func TestStructRenameRejectedWhenTagsDiverge(t *testing.T) {
+	tr := NewTranslator("yaml", "json")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic translating structurally divergent renamed structs")
+		}
+	}()
+	from := outerDivergentFromV{In: innerDivergentV{Foo: "a"}}
+	var to outerDivergentTo
+	tr.Translate(&from, &to)
+}
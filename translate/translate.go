@@ -17,7 +17,7 @@ package translate
 import (
 	"fmt"
 	"reflect"
-	"strings"
+	"sync"
 
 	"github.com/coreos/ignition/v2/config/util"
 	"github.com/coreos/vcontext/path"
@@ -39,47 +39,6 @@ var (
 	translationsType = reflect.TypeOf(TranslationSet{})
 )
 
-// Returns if this type can be translated without a custom translator. Children or other
-// ancestors might require custom translators however
-func (t translator) translatable(t1, t2 reflect.Type) bool {
-	k1 := t1.Kind()
-	k2 := t2.Kind()
-	if k1 != k2 {
-		return false
-	}
-	switch {
-	case util.IsPrimitive(k1):
-		return true
-	case util.IsInvalidInConfig(k1):
-		panic(fmt.Sprintf("Encountered invalid kind %s in config. This is a bug, please file a report", k1))
-	case k1 == reflect.Ptr || k1 == reflect.Slice:
-		return t.translatable(t1.Elem(), t2.Elem()) || t.hasTranslator(t1.Elem(), t2.Elem())
-	case k1 == reflect.Struct:
-		return t.translatableStruct(t1, t2)
-	default:
-		panic(fmt.Sprintf("Encountered unknown kind %s in config. This is a bug, please file a report", k1))
-	}
-}
-
-// precondition: t1, t2 are both of Kind 'struct'
-func (t translator) translatableStruct(t1, t2 reflect.Type) bool {
-	if t1.NumField() != t2.NumField() || t1.Name() != t2.Name() {
-		return false
-	}
-	for i := 0; i < t1.NumField(); i++ {
-		t1f := t1.Field(i)
-		t2f, ok := t2.FieldByName(t1f.Name)
-
-		if !ok {
-			return false
-		}
-		if !t.translatable(t1f.Type, t2f.Type) && !t.hasTranslator(t1f.Type, t2f.Type) {
-			return false
-		}
-	}
-	return true
-}
-
 // checks that t could reasonably be the type of a translator function
 func couldBeValidTranslator(t reflect.Type) bool {
 	if t.Kind() != reflect.Func {
@@ -88,72 +47,16 @@ func couldBeValidTranslator(t reflect.Type) bool {
 	if t.NumIn() != 1 || t.NumOut() != 2 {
 		return false
 	}
-	if util.IsInvalidInConfig(t.In(0).Kind()) ||
-		util.IsInvalidInConfig(t.Out(0).Kind()) ||
+	// util.IsInvalidInConfig predates map support and treats reflect.Map as invalid, so
+	// map-typed translator functions must be carved out of that check.
+	if (t.In(0).Kind() != reflect.Map && util.IsInvalidInConfig(t.In(0).Kind())) ||
+		(t.Out(0).Kind() != reflect.Map && util.IsInvalidInConfig(t.Out(0).Kind())) ||
 		t.Out(1) != translationsType {
 		return false
 	}
 	return true
 }
 
-// fieldName returns the name uses when (un)marshalling a field. t should be a reflect.Value of a struct,
-// index is the field index, and tag is the struct tag used when (un)marshalling (e.g. "json" or "yaml")
-func fieldName(t reflect.Value, index int, tag string) string {
-	f := t.Type().Field(index)
-	if tag == "" {
-		return f.Name
-	}
-	return strings.Split(f.Tag.Get(tag), ",")[0]
-}
-
-// translate from one type to another, but deep copy all data
-// precondition: vFrom and vTo are the same type as defined by translatable()
-// precondition: vTo is addressable and settable
-func (t translator) translateSameType(vFrom, vTo reflect.Value, fromPath, toPath path.ContextPath) {
-	k := vFrom.Kind()
-	switch {
-	case util.IsPrimitive(k):
-		// Use convert, even if not needed; type alias to primitives are not
-		// directly assignable and calling Convert on primitives does no harm
-		vTo.Set(vFrom.Convert(vTo.Type()))
-		t.translations.AddTranslation(fromPath, toPath)
-	case k == reflect.Ptr:
-		if vFrom.IsNil() {
-			return
-		}
-		vTo.Set(reflect.New(vTo.Type().Elem()))
-		t.translate(vFrom.Elem(), vTo.Elem(), fromPath, toPath)
-	case k == reflect.Slice:
-		if vFrom.IsNil() {
-			return
-		}
-		vTo.Set(reflect.MakeSlice(vTo.Type(), vFrom.Len(), vFrom.Len()))
-		for i := 0; i < vFrom.Len(); i++ {
-			t.translate(vFrom.Index(i), vTo.Index(i), fromPath.Append(i), toPath.Append(i))
-		}
-	case k == reflect.Struct:
-		for i := 0; i < vFrom.NumField(); i++ {
-			fieldGoName := vFrom.Type().Field(i).Name
-			toStructField, ok := vTo.Type().FieldByName(fieldGoName)
-			if !ok {
-				panic("vTo did not have a matching type. This is a bug; please file a report")
-			}
-			toFieldIndex := toStructField.Index[0]
-			vToField := vTo.FieldByName(fieldGoName)
-
-			from := fromPath.Append(fieldName(vFrom, i, fromPath.Tag))
-			to := toPath.Append(fieldName(vTo, toFieldIndex, toPath.Tag))
-			if vFrom.Type().Field(i).Anonymous {
-				from = fromPath
-				to = toPath
-			}
-			t.translate(vFrom.Field(i), vToField, from, to)
-		}
-	default:
-		panic("Encountered types that are not the same when they should be. This is a bug, please file a report")
-	}
-}
-
 // helper to return if a custom translator was defined
 func (t translator) hasTranslator(tFrom, tTo reflect.Type) bool {
 	return t.getTranslator(tFrom, tTo).IsValid()
@@ -161,27 +64,8 @@ func (t translator) hasTranslator(tFrom, tTo reflect.Type) bool {
 
 // vTo must be addressable, should be acquired by calling reflect.ValueOf() on a variable of the correct type
 func (t translator) translate(vFrom, vTo reflect.Value, fromPath, toPath path.ContextPath) {
-	tFrom := vFrom.Type()
-	tTo := vTo.Type()
-	if fnv := t.getTranslator(tFrom, tTo); fnv.IsValid() {
-		returns := fnv.Call([]reflect.Value{vFrom})
-		vTo.Set(returns[0])
-
-		// handle all the translations and "rebase" them to our current place
-		retSet := returns[1].Interface().(TranslationSet)
-		for _, trans := range retSet.Set {
-			from := fromPath.Append(trans.From.Path...)
-			to := toPath.Append(trans.To.Path...)
-			t.translations.AddTranslation(from, to)
-		}
-		return
-	}
-	if t.translatable(tFrom, tTo) {
-		t.translateSameType(vFrom, vTo, fromPath, toPath)
-		return
-	}
-
-	panic(fmt.Sprintf("Translator not defined for %v to %v", tFrom, tTo))
+	p := getPlan(t, vFrom.Type(), vTo.Type(), t.translations.FromTag, t.translations.ToTag)
+	t.execPlan(p, vFrom, vTo, fromPath, toPath)
 }
 
 type Translator interface {
@@ -189,8 +73,30 @@ type Translator interface {
 	// func(fromType) -> (toType, TranslationSet). The translator should return the set of all
 	// translations it did.
 	AddCustomTranslator(t interface{})
+	// Adds a custom translator like AddCustomTranslator, plus its inverse, of the form
+	// func(toType) -> (fromType, TranslationSet). Registering inverses for every custom
+	// translator in use allows TranslateReverse to be used.
+	AddBidirectionalTranslator(fwd, inv interface{})
+	// Adds a custom translator like AddCustomTranslator, but resolved by name instead of by
+	// (fromType, toType). Fields tagged `translate:"name"` use the translator registered under
+	// that name instead of the usual type-pair matching, so two fields of the same type can be
+	// translated differently.
+	AddNamedTranslator(name string, fn interface{})
+	// AllowStructRename controls whether two structurally identical structs (same field names,
+	// same marshalled field names, and structurally identical field types) may be translated
+	// even when their type names differ, e.g. a wrapper struct renamed on one side only. Type
+	// aliases resolve to the same type and are accepted either way. Defaults to true.
+	AllowStructRename(allow bool)
+	// RequireStructNameMatch pins specific (fromTypeName, toTypeName) pairs so they still require
+	// an exact name match, overriding AllowStructRename(true) for just those pairs.
+	RequireStructNameMatch(pairs ...[2]string)
 	// Also returns a list of source and dest paths, autocompleted by fromTag and toTag
 	Translate(from, to interface{}) TranslationSet
+	// TranslateReverse translates to back into from, using the inverse of every registered
+	// bidirectional translator. A type pair that has only a forward custom translator
+	// registered is translated by the default rules, which panic if the types are not
+	// otherwise translatable.
+	TranslateReverse(to, from interface{}) TranslationSet
 }
 
 // Translation represents how a path changes when translating. If something at $yaml.storage.filesystems.4
@@ -209,13 +115,18 @@ type TranslationSet struct {
 	FromTag string
 	ToTag   string
 	Set     map[string]Translation
+	// fromIndex mirrors Set, but keyed by the string representation of the source
+	// path instead of the destination path. It is kept in sync with Set by
+	// AddTranslation and backs LookupFrom.
+	fromIndex map[string]Translation
 }
 
 func NewTranslationSet(fromTag, toTag string) TranslationSet {
 	return TranslationSet{
-		FromTag: fromTag,
-		ToTag:   toTag,
-		Set:     map[string]Translation{},
+		FromTag:   fromTag,
+		ToTag:     toTag,
+		Set:       map[string]Translation{},
+		fromIndex: map[string]Translation{},
 	}
 }
 
@@ -236,8 +147,25 @@ func (ts TranslationSet) AddTranslation(from, to path.ContextPath) {
 		From: from,
 		To:   to,
 	}
-	toString := translation.To.String()
-	ts.Set[toString] = translation
+	ts.Set[translation.To.String()] = translation
+	ts.fromIndex[translation.From.String()] = translation
+}
+
+// LookupFrom looks up the translation whose source path is from, e.g. to map a
+// path in the generated config back to the line it came from in the source. If
+// several translations share that source path, the one added last is returned.
+func (ts TranslationSet) LookupFrom(from path.ContextPath) (Translation, bool) {
+	t, ok := ts.fromIndex[from.String()]
+	return t, ok
+}
+
+// Invert returns a TranslationSet with From and To (and FromTag and ToTag) swapped.
+func (ts TranslationSet) Invert() TranslationSet {
+	ret := NewTranslationSet(ts.ToTag, ts.FromTag)
+	for _, tr := range ts.Set {
+		ret.AddTranslation(tr.To, tr.From)
+	}
+	return ret
 }
 
 // Shortcut for AddTranslation for identity translations
@@ -278,11 +206,8 @@ func (ts TranslationSet) Prefix(prefix interface{}) TranslationSet {
 // the TranslationSet returned by Translator.Translate()
 func NewTranslator(fromTag, toTag string) Translator {
 	return &translator{
-		translations: TranslationSet{
-			FromTag: fromTag,
-			ToTag:   toTag,
-			Set:     map[string]Translation{},
-		},
+		translations: NewTranslationSet(fromTag, toTag),
+		planCache:    newPlanCache(),
 	}
 }
 
@@ -292,6 +217,20 @@ type translator struct {
 	// All trivially translated fields use the default behavior.
 	translators  []reflect.Value
 	translations TranslationSet
+	// List of inverses of translators, registered via AddBidirectionalTranslator. Used by
+	// TranslateReverse, which translates as if these were the (only) forward translators.
+	inverses []reflect.Value
+	// Translators registered under a name via AddNamedTranslator, keyed by that name. Selected
+	// by a field's `translate:"name"` struct tag instead of by (fromType, toType).
+	namedTranslators map[string]reflect.Value
+	// If true, two structurally identical structs must also have matching type names. Set via
+	// AllowStructRename(false); defaults to false, i.e. renames are allowed.
+	strictStructNames bool
+	// (fromTypeName, toTypeName) pairs that require an exact name match regardless of
+	// strictStructNames, set via RequireStructNameMatch.
+	requiredNamePairs map[[2]string]bool
+	// Memoized plans, scoped to this Translator instance; see newPlanCache.
+	planCache *sync.Map
 }
 
 // fn should be of the form func(fromType, translationsMap) -> toType
@@ -304,6 +243,60 @@ func (t *translator) AddCustomTranslator(fn interface{}) {
 	t.translators = append(t.translators, fnv)
 }
 
+// fwd should be of the form func(fromType) -> (toType, TranslationSet), inv its inverse
+// func(toType) -> (fromType, TranslationSet)
+func (t *translator) AddBidirectionalTranslator(fwd, inv interface{}) {
+	fwdv := reflect.ValueOf(fwd)
+	invv := reflect.ValueOf(inv)
+	if !couldBeValidTranslator(fwdv.Type()) || !couldBeValidTranslator(invv.Type()) {
+		panic("Tried to register invalid translator function")
+	}
+	if fwdv.Type().In(0) != invv.Type().Out(0) || fwdv.Type().Out(0) != invv.Type().In(0) {
+		panic("Tried to register mismatched bidirectional translator functions")
+	}
+	t.translators = append(t.translators, fwdv)
+	t.inverses = append(t.inverses, invv)
+}
+
+// fn should be of the form func(fromType) -> (toType, TranslationSet). It is selected by name,
+// via a field's `translate:"name"` struct tag, rather than by its (fromType, toType) pair.
+func (t *translator) AddNamedTranslator(name string, fn interface{}) {
+	fnv := reflect.ValueOf(fn)
+	if !couldBeValidTranslator(fnv.Type()) {
+		panic("Tried to register invalid translator function")
+	}
+	if t.namedTranslators == nil {
+		t.namedTranslators = map[string]reflect.Value{}
+	}
+	t.namedTranslators[name] = fnv
+}
+
+func (t translator) getNamedTranslator(name string) (reflect.Value, bool) {
+	fnv, ok := t.namedTranslators[name]
+	return fnv, ok
+}
+
+func (t *translator) AllowStructRename(allow bool) {
+	t.strictStructNames = !allow
+}
+
+func (t *translator) RequireStructNameMatch(pairs ...[2]string) {
+	if t.requiredNamePairs == nil {
+		t.requiredNamePairs = map[[2]string]bool{}
+	}
+	for _, p := range pairs {
+		t.requiredNamePairs[p] = true
+	}
+}
+
+// requireNameMatch returns whether the (fromName, toName) struct pair must have identical names
+func (t translator) requireNameMatch(fromName, toName string) bool {
+	if t.strictStructNames {
+		return true
+	}
+	return t.requiredNamePairs[[2]string{fromName, toName}]
+}
+
 func (t translator) getTranslator(from, to reflect.Type) reflect.Value {
 	for _, fn := range t.translators {
 		if fn.Type().In(0) == from && fn.Type().Out(0) == to {
@@ -323,11 +316,18 @@ func (t translator) Translate(from, to interface{}) TranslationSet {
 	fv = fv.Elem()
 	tv = tv.Elem()
 	// Make sure to clear this every time`
-	t.translations = TranslationSet{
-		FromTag: t.translations.FromTag,
-		ToTag:   t.translations.ToTag,
-		Set:     map[string]Translation{},
-	}
+	t.translations = NewTranslationSet(t.translations.FromTag, t.translations.ToTag)
 	t.translate(fv, tv, path.New(t.translations.FromTag), path.New(t.translations.ToTag))
 	return t.translations
 }
+
+// TranslateReverse translates to back into from, as if the inverses registered via
+// AddBidirectionalTranslator were this Translator's (only) custom translators.
+func (t translator) TranslateReverse(to, from interface{}) TranslationSet {
+	rev := t
+	rev.translators = t.inverses
+	rev.inverses = nil
+	rev.translations = NewTranslationSet(t.translations.ToTag, t.translations.FromTag)
+	rev.planCache = newPlanCache()
+	return rev.Translate(to, from)
+}
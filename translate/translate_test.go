@@ -0,0 +1,116 @@
+// Copyright 2019 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coreos/vcontext/path"
+)
+
+// TestNamedTranslator covers two sibling fields of the same Go type being routed
+// through different custom translators via the `translate:"name"` struct tag.
+func TestNamedTranslator(t *testing.T) {
+	type fromT struct {
+		Upper string `yaml:"upper" translate:"upper"`
+		Lower string `yaml:"lower" translate:"lower"`
+	}
+	type toT struct {
+		Upper string `json:"upper"`
+		Lower string `json:"lower"`
+	}
+
+	tr := NewTranslator("yaml", "json")
+	tr.AddNamedTranslator("upper", func(s string) (string, TranslationSet) {
+		ts := NewTranslationSet("yaml", "json")
+		ts.AddTranslation(path.New("yaml"), path.New("json"))
+		return strings.ToUpper(s), ts
+	})
+	tr.AddNamedTranslator("lower", func(s string) (string, TranslationSet) {
+		ts := NewTranslationSet("yaml", "json")
+		ts.AddTranslation(path.New("yaml"), path.New("json"))
+		return strings.ToLower(s), ts
+	})
+
+	from := fromT{Upper: "foo", Lower: "BAR"}
+	var to toT
+	set := tr.Translate(&from, &to)
+
+	if to.Upper != "FOO" {
+		t.Errorf("expected Upper to be translated via the \"upper\" translator, got %q", to.Upper)
+	}
+	if to.Lower != "bar" {
+		t.Errorf("expected Lower to be translated via the \"lower\" translator, got %q", to.Lower)
+	}
+
+	if _, ok := set.Set[path.New("json", "upper").String()]; !ok {
+		t.Errorf("expected a translation at $json.upper, set was: %v", set)
+	}
+	if _, ok := set.Set[path.New("json", "lower").String()]; !ok {
+		t.Errorf("expected a translation at $json.lower, set was: %v", set)
+	}
+}
+
+// TestTranslateMap covers translating a struct field of kind map, end to end:
+// values are translated, a path segment is derived from each key, and a nil
+// map stays nil instead of becoming an empty one.
+func TestTranslateMap(t *testing.T) {
+	type fromT struct {
+		Labels map[string]string `yaml:"labels"`
+		Nil    map[string]string `yaml:"nil"`
+	}
+	type toT struct {
+		Labels map[string]string `json:"labels"`
+		Nil    map[string]string `json:"nil"`
+	}
+
+	tr := NewTranslator("yaml", "json")
+	from := fromT{Labels: map[string]string{"foo": "bar"}}
+	var to toT
+	set := tr.Translate(&from, &to)
+
+	if to.Labels == nil || to.Labels["foo"] != "bar" {
+		t.Errorf("expected Labels to be translated to map[foo:bar], got %v", to.Labels)
+	}
+	if to.Nil != nil {
+		t.Errorf("expected a nil map to stay nil, got %v", to.Nil)
+	}
+
+	if _, ok := set.Set[path.New("json", "labels", "foo").String()]; !ok {
+		t.Errorf("expected a translation at $json.labels.foo, set was: %v", set)
+	}
+}
+
+// TestNamedTranslatorUndefined covers a field referencing a name that was never
+// registered via AddNamedTranslator.
+func TestNamedTranslatorUndefined(t *testing.T) {
+	type fromT struct {
+		Foo string `yaml:"foo" translate:"does-not-exist"`
+	}
+	type toT struct {
+		Foo string `json:"foo"`
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for an undefined named translator")
+		}
+	}()
+	tr := NewTranslator("yaml", "json")
+	var from fromT
+	var to toT
+	tr.Translate(&from, &to)
+}